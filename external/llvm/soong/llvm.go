@@ -15,6 +15,9 @@
 package llvm
 
 import (
+	"os"
+	"path/filepath"
+
 	"android/soong/android"
 	"android/soong/cc"
 
@@ -47,6 +50,36 @@ func hostFlags(ctx android.LoadHookContext) []string {
 	return cflags
 }
 
+func windowsCflags(ctx android.LoadHookContext) []string {
+	// Mingw's ld rejects objects carrying the .debug_pubnames/.debug_pubtypes
+	// sections clang emits for big binaries ("too many sections"); drop just
+	// those rather than disabling debug info entirely. cxa_atexit isn't
+	// supported by the MinGW runtime either.
+	cflags := []string{
+		"-gno-pubnames",
+		"-fno-use-cxa-atexit",
+	}
+
+	if ctx.Config().Getenv("HOST_CROSS_OS") == "windows" {
+		// LTO is not yet supported by the MinGW toolchain.
+		cflags = append(cflags, "-fno-lto")
+	}
+
+	return cflags
+}
+
+func windowsLdflags(ctx android.LoadHookContext) []string {
+	var ldflags []string
+
+	if ctx.Config().Getenv("HOST_CROSS_OS") == "windows" {
+		// Matches the -fno-lto cflag above; the linker driver needs the same
+		// flag or it'll try to consume LTO bitcode that was never produced.
+		ldflags = append(ldflags, "-fno-lto")
+	}
+
+	return ldflags
+}
+
 func llvmDefaults(ctx android.LoadHookContext) {
 	type props struct {
 		Target struct {
@@ -77,7 +110,63 @@ func llvmDefaults(ctx android.LoadHookContext) {
 	ctx.AppendProperties(p)
 }
 
-func forceBuildLlvmComponents(ctx android.LoadHookContext) {
+// forceBuildLlvmComponentsProperties lets a downstream Android.bp pick which
+// targets force-build LLVM's components without reaching for
+// FORCE_BUILD_LLVM_COMPONENTS, and override the darwin_arm64 default that's
+// otherwise always force-built.
+type forceBuildLlvmComponentsProperties struct {
+	// Targets (named like "linux_bionic_arm64") that should force-build
+	// LLVM components regardless of FORCE_BUILD_LLVM_COMPONENTS.
+	Force_build_targets []string
+	// Targets that should never force-build LLVM components. Takes
+	// precedence over both the env var and Force_build_targets.
+	Exclude_targets []string
+	// Overrides the enabled state darwin_arm64 gets when neither
+	// FORCE_BUILD_LLVM_COMPONENTS nor a host sanitizer is set (true unless
+	// overridden). Has no effect when either of those is set, since the
+	// whole matrix is then left unset.
+	Default_enabled_on_darwin_arm64 *bool
+}
+
+// forceBuildLlvmComponentsTargets computes the enabled/disabled matrix for
+// forceBuildLlvmComponents, keyed by Target.<os>_<arch> name. It's split out
+// from forceBuildLlvmComponents so the env-var/property precedence can be
+// unit tested without going through a LoadHookContext.
+func forceBuildLlvmComponentsTargets(forceBuild bool, targetProps *forceBuildLlvmComponentsProperties) map[string]*bool {
+	darwinArm64Default := proptools.BoolPtr(true)
+	if targetProps.Default_enabled_on_darwin_arm64 != nil {
+		darwinArm64Default = targetProps.Default_enabled_on_darwin_arm64
+	}
+
+	targetEnabled := map[string]*bool{
+		"darwin_arm64":       nil,
+		"host":               nil,
+		"linux_bionic_arm64": nil,
+	}
+	if !forceBuild {
+		targetEnabled["darwin_arm64"] = darwinArm64Default
+		targetEnabled["host"] = proptools.BoolPtr(false)
+		targetEnabled["linux_bionic_arm64"] = proptools.BoolPtr(true)
+	}
+
+	// Force_build_targets/Exclude_targets are resolved per Target.<os>_<arch>
+	// on top of the env-var decision above, with Exclude_targets winning any
+	// conflict against Force_build_targets.
+	for _, target := range targetProps.Force_build_targets {
+		if _, ok := targetEnabled[target]; ok {
+			targetEnabled[target] = proptools.BoolPtr(true)
+		}
+	}
+	for _, target := range targetProps.Exclude_targets {
+		if _, ok := targetEnabled[target]; ok {
+			targetEnabled[target] = proptools.BoolPtr(false)
+		}
+	}
+
+	return targetEnabled
+}
+
+func forceBuildLlvmComponents(ctx android.LoadHookContext, targetProps *forceBuildLlvmComponentsProperties) {
 	forceBuild := false
 	if ctx.Config().IsEnvTrue("FORCE_BUILD_LLVM_COMPONENTS") {
 		forceBuild = true
@@ -86,31 +175,70 @@ func forceBuildLlvmComponents(ctx android.LoadHookContext) {
 		forceBuild = true
 	}
 
-	if !forceBuild {
-		type props struct {
-			Target struct {
-				Darwin_arm64 struct {
-					Enabled *bool
-				}
-				Host struct {
-					Enabled *bool
-				}
-				Linux_bionic_arm64 struct {
-					Enabled *bool
-				}
+	targetEnabled := forceBuildLlvmComponentsTargets(forceBuild, targetProps)
+
+	type props struct {
+		Target struct {
+			Darwin_arm64 struct {
+				Enabled *bool
+			}
+			Host struct {
+				Enabled *bool
+			}
+			Linux_bionic_arm64 struct {
+				Enabled *bool
 			}
 		}
-		p := &props{}
-		p.Target.Darwin_arm64.Enabled = proptools.BoolPtr(true)
-		p.Target.Host.Enabled = proptools.BoolPtr(false)
-		p.Target.Linux_bionic_arm64.Enabled = proptools.BoolPtr(true)
-		ctx.AppendProperties(p)
 	}
+	p := &props{}
+	p.Target.Darwin_arm64.Enabled = targetEnabled["darwin_arm64"]
+	p.Target.Host.Enabled = targetEnabled["host"]
+	p.Target.Linux_bionic_arm64.Enabled = targetEnabled["linux_bionic_arm64"]
+
+	ctx.AppendProperties(p)
+}
+
+// llvmWindowsProperties lets a depending module (e.g. libLLVM) stage extra
+// MinGW-only cflags through llvm_windows_defaults instead of writing its own
+// Target.Windows.Cflags block.
+type llvmWindowsProperties struct {
+	Cflags_windows_cross []string
+}
+
+// llvmWindowsDefaults centralizes the MinGW cross-compile configuration that
+// used to be scattered across Android.bp files via inverted Not_windows
+// conditions. Modules that build Windows host tools, such as libLLVM, can
+// depend on llvm_windows_defaults directly and layer their own
+// Cflags_windows_cross on top instead of duplicating these flags.
+func llvmWindowsDefaults(ctx android.LoadHookContext, windowsProps *llvmWindowsProperties) {
+	type props struct {
+		Target struct {
+			Windows struct {
+				Cflags  []string
+				Ldflags []string
+				Enabled *bool
+			}
+		}
+	}
+
+	p := &props{}
+	p.Target.Windows.Cflags = append(windowsCflags(ctx), windowsProps.Cflags_windows_cross...)
+	p.Target.Windows.Ldflags = windowsLdflags(ctx)
+
+	if ctx.Config().IsEnvTrue("FORCE_BUILD_LLVM_WINDOWS") || ctx.Config().IsEnvTrue("BUILD_HOST_static") {
+		p.Target.Windows.Enabled = proptools.BoolPtr(true)
+	}
+
+	ctx.AppendProperties(p)
 }
 
 func init() {
 	android.RegisterModuleType("llvm_defaults", llvmDefaultsFactory)
 	android.RegisterModuleType("force_build_llvm_components_defaults", forceBuildLlvmComponentsDefaultsFactory)
+	android.RegisterModuleType("llvm_windows_defaults", llvmWindowsDefaultsFactory)
+	android.RegisterModuleType("llvm_assertions_defaults", llvmAssertionsDefaultsFactory)
+	android.RegisterModuleType("llvm_pgo_defaults", llvmPgoDefaultsFactory)
+	android.RegisterModuleType("llvm_thinlto_defaults", llvmThinltoDefaultsFactory)
 }
 
 func llvmDefaultsFactory() android.Module {
@@ -122,6 +250,114 @@ func llvmDefaultsFactory() android.Module {
 
 func forceBuildLlvmComponentsDefaultsFactory() android.Module {
 	module := cc.DefaultsFactory()
-	android.AddLoadHook(module, forceBuildLlvmComponents)
+	targetProps := &forceBuildLlvmComponentsProperties{}
+	module.AddProperties(targetProps)
+	android.AddLoadHook(module, func(ctx android.LoadHookContext) {
+		forceBuildLlvmComponents(ctx, targetProps)
+	})
+	return module
+}
+
+func llvmWindowsDefaultsFactory() android.Module {
+	module := cc.DefaultsFactory()
+	windowsProps := &llvmWindowsProperties{}
+	module.AddProperties(windowsProps)
+	android.AddLoadHook(module, func(ctx android.LoadHookContext) {
+		llvmWindowsDefaults(ctx, windowsProps)
+	})
+	return module
+}
+
+func llvmAssertionsDefaultsFactory() android.Module {
+	module := cc.DefaultsFactory()
+	android.AddLoadHook(module, llvmAssertionsDefaults)
+	return module
+}
+
+func llvmPgoDefaultsFactory() android.Module {
+	module := cc.DefaultsFactory()
+	android.AddLoadHook(module, llvmPgoDefaults)
 	return module
 }
+
+func llvmThinltoDefaultsFactory() android.Module {
+	module := cc.DefaultsFactory()
+	android.AddLoadHook(module, llvmThinltoDefaults)
+	return module
+}
+
+// llvmAssertionsDefaults turns on LLVM's internal assertions independent of
+// whether the rest of the tree is a debug (_DEBUG) build, so bots can flip
+// FORCE_BUILD_LLVM_ASSERTIONS on a release tree to catch invariant breaks.
+func llvmAssertionsDefaults(ctx android.LoadHookContext) {
+	type props struct {
+		Cflags []string
+	}
+
+	p := &props{}
+	if ctx.Config().IsEnvTrue("FORCE_BUILD_LLVM_ASSERTIONS") {
+		p.Cflags = append(p.Cflags, "-UNDEBUG", "-DLLVM_ENABLE_ASSERTIONS=1")
+	}
+
+	ctx.AppendProperties(p)
+}
+
+// llvmPgoProfileName is the merged profile Soong looks for inside
+// LLVM_PGO_PROFILE_DIR to decide whether that directory already holds a
+// profile to consume.
+const llvmPgoProfileName = "llvm.profdata"
+
+// llvmPgoDefaults wires up profile-guided optimization for LLVM itself.
+// Pointing LLVM_PGO_PROFILE_DIR at a directory that already holds
+// llvm.profdata switches the build to consume it (-fprofile-use=);
+// otherwise the directory is treated as the destination for a
+// profile-generating build (-fprofile-generate=).
+func llvmPgoDefaults(ctx android.LoadHookContext) {
+	type props struct {
+		Cflags []string
+	}
+
+	p := &props{}
+	if profileDir := ctx.Config().Getenv("LLVM_PGO_PROFILE_DIR"); profileDir != "" {
+		profilePath := filepath.Join(profileDir, llvmPgoProfileName)
+		if _, err := os.Stat(profilePath); err == nil {
+			p.Cflags = append(p.Cflags, "-fprofile-use="+profilePath)
+		} else {
+			p.Cflags = append(p.Cflags, "-fprofile-generate="+profileDir)
+		}
+		// The profile was collected from a differently structured build;
+		// don't fail the build over stale counters.
+		p.Cflags = append(p.Cflags, "-Wno-backend-plugin")
+	}
+
+	ctx.AppendProperties(p)
+}
+
+// llvmThinltoDefaults enables ThinLTO for LLVM's own build. It backs off on
+// MinGW, which doesn't support LTO, and on sanitizer host builds, where LTO
+// and the sanitizer instrumentation don't mix.
+func llvmThinltoDefaults(ctx android.LoadHookContext) {
+	type props struct {
+		Cflags  []string
+		Ldflags []string
+	}
+
+	p := &props{}
+	if !ctx.Config().IsEnvTrue("LLVM_ENABLE_THINLTO") {
+		ctx.AppendProperties(p)
+		return
+	}
+	if ctx.Config().Getenv("HOST_CROSS_OS") == "windows" {
+		ctx.AppendProperties(p)
+		return
+	}
+	if len(ctx.Config().SanitizeHost()) > 0 {
+		ctx.AppendProperties(p)
+		return
+	}
+
+	p.Cflags = append(p.Cflags, "-flto=thin")
+	p.Ldflags = append(p.Ldflags, "-flto=thin")
+
+	ctx.AppendProperties(p)
+}
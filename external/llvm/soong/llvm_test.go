@@ -0,0 +1,90 @@
+// Copyright (C) 2016 The Android Open Source Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package llvm
+
+import (
+	"testing"
+
+	"github.com/google/blueprint/proptools"
+)
+
+func boolPtrEq(a, b *bool) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func TestForceBuildLlvmComponentsTargetsEnvVar(t *testing.T) {
+	// With no properties set, the env-var decision alone drives the matrix.
+	targets := forceBuildLlvmComponentsTargets(false, &forceBuildLlvmComponentsProperties{})
+	want := map[string]*bool{
+		"darwin_arm64":       proptools.BoolPtr(true),
+		"host":               proptools.BoolPtr(false),
+		"linux_bionic_arm64": proptools.BoolPtr(true),
+	}
+	for target, wantEnabled := range want {
+		if got := targets[target]; !boolPtrEq(got, wantEnabled) {
+			t.Errorf("target %q: got enabled %v, want %v", target, got, wantEnabled)
+		}
+	}
+
+	// FORCE_BUILD_LLVM_COMPONENTS leaves the whole matrix unset.
+	targets = forceBuildLlvmComponentsTargets(true, &forceBuildLlvmComponentsProperties{})
+	for target, enabled := range targets {
+		if enabled != nil {
+			t.Errorf("target %q: got enabled %v with forceBuild, want unset", target, *enabled)
+		}
+	}
+}
+
+func TestForceBuildLlvmComponentsTargetsProperties(t *testing.T) {
+	targetProps := &forceBuildLlvmComponentsProperties{
+		Force_build_targets:             []string{"host"},
+		Default_enabled_on_darwin_arm64: proptools.BoolPtr(false),
+	}
+	targets := forceBuildLlvmComponentsTargets(false, targetProps)
+
+	if got := targets["host"]; !boolPtrEq(got, proptools.BoolPtr(true)) {
+		t.Errorf("host: got enabled %v, want true via Force_build_targets", got)
+	}
+	if got := targets["darwin_arm64"]; !boolPtrEq(got, proptools.BoolPtr(false)) {
+		t.Errorf("darwin_arm64: got enabled %v, want false via Default_enabled_on_darwin_arm64", got)
+	}
+}
+
+func TestForceBuildLlvmComponentsTargetsPrecedence(t *testing.T) {
+	// Exclude_targets wins even when the same target is also force-built and
+	// the env var would otherwise force-build everything.
+	targetProps := &forceBuildLlvmComponentsProperties{
+		Force_build_targets: []string{"linux_bionic_arm64"},
+		Exclude_targets:     []string{"linux_bionic_arm64"},
+	}
+	targets := forceBuildLlvmComponentsTargets(true, targetProps)
+
+	if got := targets["linux_bionic_arm64"]; !boolPtrEq(got, proptools.BoolPtr(false)) {
+		t.Errorf("linux_bionic_arm64: got enabled %v, want false (Exclude_targets beats Force_build_targets and the env var)", got)
+	}
+
+	// Unknown target names are ignored rather than silently creating new
+	// Target.<os>_<arch> entries.
+	targetProps = &forceBuildLlvmComponentsProperties{
+		Force_build_targets: []string{"windows_x86_64"},
+	}
+	targets = forceBuildLlvmComponentsTargets(false, targetProps)
+	if _, ok := targets["windows_x86_64"]; ok {
+		t.Errorf("unexpected entry for unknown target windows_x86_64")
+	}
+}